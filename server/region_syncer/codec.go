@@ -0,0 +1,144 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+// This file negotiates and renders the optional wire codecs for region sync
+// batches. RegionSyncCodec is this package's own type, not pdpb's - the
+// wire fields it maps to don't exist in the vendored kvproto yet, so
+// reading and stamping them is confined to supportedCodecsFrom and
+// buildSyncRegionResponse (see wire_pdnext.go and wire_stub.go).
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pkg/errors"
+)
+
+// RegionSyncCodec identifies how a batch of regions is encoded on the wire.
+type RegionSyncCodec int32
+
+const (
+	RegionSyncCodecFull RegionSyncCodec = iota
+	RegionSyncCodecSnappy
+	RegionSyncCodecDelta
+)
+
+// negotiateCodec picks the richest codec both the leader and the follower
+// understand, preferring delta over plain compression over the
+// uncompressed fallback every follower is guaranteed to support.
+//
+// A follower whose startIndex falls outside the history buffer's retained
+// window just rebuilt its entire region view from a full snapshot (see
+// syncFullRegion) and has no per-region baseline of its own yet. Diffing
+// against it would ship nearly every region in full anyway while still
+// paying to track a baseline entry for each one it has ever seen, so delta
+// is skipped for that follower in favour of plain compression instead, or
+// of the uncompressed fallback if the follower doesn't support compression.
+func negotiateCodec(supported []RegionSyncCodec, startIndex uint64, history *historyBuffer) RegionSyncCodec {
+	var snappyOK, deltaOK bool
+	for _, c := range supported {
+		switch c {
+		case RegionSyncCodecSnappy:
+			snappyOK = true
+		case RegionSyncCodecDelta:
+			deltaOK = true
+		}
+	}
+	if deltaOK && !history.covers(startIndex) {
+		deltaOK = false
+	}
+	switch {
+	case deltaOK:
+		return RegionSyncCodecDelta
+	case snappyOK:
+		return RegionSyncCodecSnappy
+	default:
+		return RegionSyncCodecFull
+	}
+}
+
+// regionBatch is the set of region changes produced by one RunServer
+// iteration. It is shared by every bound follower, each of which may
+// render it onto the wire differently depending on the codec it
+// negotiated. Full and Snappy encodings depend only on the batch itself,
+// so responseFor computes and caches each of those at most once regardless
+// of how many followers ask for it. Delta encoding is deliberately not
+// cached here: it is computed against each follower's own last-shipped
+// baseline (see followerStream.diffRegion), which differs from follower to
+// follower, so it is rendered by followerStream.render instead.
+type regionBatch struct {
+	clusterID  uint64
+	startIndex uint64
+	regions    []*metapb.Region
+
+	fullOnce   sync.Once
+	fullResp   *pdpb.SyncRegionResponse
+	snappyOnce sync.Once
+	snappyResp *pdpb.SyncRegionResponse
+	snappyErr  error
+}
+
+// responseFor renders the batch using codec, falling back to Full if the
+// requested codec can't be produced (for example a marshal failure). It
+// must not be called with RegionSyncCodecDelta; use followerStream.render
+// for that instead.
+func (b *regionBatch) responseFor(codec RegionSyncCodec) *pdpb.SyncRegionResponse {
+	if len(b.regions) == 0 {
+		// Nothing to compress - this is a keepalive tick.
+		codec = RegionSyncCodecFull
+	}
+	if codec == RegionSyncCodecSnappy {
+		b.snappyOnce.Do(func() {
+			b.snappyResp, b.snappyErr = b.encodeCompressed(RegionSyncCodecSnappy, b.regions)
+		})
+		if b.snappyErr == nil {
+			return b.snappyResp
+		}
+	}
+	b.fullOnce.Do(func() {
+		b.fullResp = buildSyncRegionResponse(b.clusterID, b.startIndex, b.regions, RegionSyncCodecFull, nil)
+	})
+	return b.fullResp
+}
+
+func (b *regionBatch) encodeCompressed(codec RegionSyncCodec, regions []*metapb.Region) (*pdpb.SyncRegionResponse, error) {
+	payload, err := marshalRegions(regions)
+	if err != nil {
+		return nil, err
+	}
+	return buildSyncRegionResponse(b.clusterID, b.startIndex, nil, codec, snappy.Encode(nil, payload)), nil
+}
+
+// marshalRegions concatenates the marshaled form of regions as
+// varint-length-prefixed records, so the follower can split them back
+// apart without a wrapper message.
+func marshalRegions(regions []*metapb.Region) ([]byte, error) {
+	var buf bytes.Buffer
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, region := range regions {
+		data, err := region.Marshal()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		n := binary.PutUvarint(lenBuf, uint64(len(data)))
+		buf.Write(lenBuf[:n])
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,100 @@
+// +build pdnext
+
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+// Gated behind pdnext like wire_pdnext.go: without it, buildSyncRegionResponse
+// can't actually put a compressed payload on the wire, so comparing codecs'
+// wire size would just be measuring the stub's inability to produce anything
+// but the full form.
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+// BenchmarkRegionBatchCodecs reports the wire size each codec produces for
+// one broadcast tick drawn from a synthetic 1M-region trace, in the
+// steady-state case negotiateCodec targets: only a small fraction of
+// regions actually changed since the follower's last tick. It exists to
+// justify preferring delta over snappy over full: on a realistic trace
+// like this, delta should need dramatically fewer bytes on the wire than
+// resending the whole changed batch under the other two codecs.
+func BenchmarkRegionBatchCodecs(b *testing.B) {
+	const regionCount = 1000000
+	const churn = 1000
+
+	base := make([]*metapb.Region, regionCount)
+	for i := range base {
+		base[i] = syntheticRegion(uint64(i), 0)
+	}
+
+	// Warm a follower's delta baseline the way binding a stream after its
+	// first catch-up tick would, so the benchmark measures steady-state
+	// churn rather than the unavoidable first-seen cost of every region.
+	follower := newFollowerStream("bench", nil, 0, 0, RegionSyncCodecDelta)
+	for _, r := range base {
+		follower.diffRegion(r)
+	}
+
+	changed := make([]*metapb.Region, churn)
+	for i := 0; i < churn; i++ {
+		changed[i] = syntheticRegion(base[i].GetId(), 1)
+	}
+
+	codecs := map[string]RegionSyncCodec{
+		"full":   RegionSyncCodecFull,
+		"snappy": RegionSyncCodecSnappy,
+		"delta":  RegionSyncCodecDelta,
+	}
+	for name, codec := range codecs {
+		name, codec := name, codec
+		b.Run(name, func(b *testing.B) {
+			follower.codec = codec
+			var size int
+			for i := 0; i < b.N; i++ {
+				// Restore the pre-churn baseline so every iteration diffs
+				// the changed regions against their previous version.
+				b.StopTimer()
+				for _, r := range base[:churn] {
+					follower.lastShipped[r.GetId()] = r
+				}
+				b.StartTimer()
+				batch := &regionBatch{regions: changed}
+				size = follower.render(batch).Size()
+			}
+			b.ReportMetric(float64(size), "bytes/tick")
+		})
+	}
+}
+
+func syntheticRegion(id, version uint64) *metapb.Region {
+	return &metapb.Region{
+		Id:       id,
+		StartKey: []byte(fmt.Sprintf("key-%d", id)),
+		EndKey:   []byte(fmt.Sprintf("key-%d", id+1)),
+		RegionEpoch: &metapb.RegionEpoch{
+			ConfVer: 1,
+			Version: version,
+		},
+		Peers: []*metapb.Peer{
+			{Id: id*3 + 1, StoreId: id % 3},
+			{Id: id*3 + 2, StoreId: (id + 1) % 3},
+			{Id: id*3 + 3, StoreId: (id + 2) % 3},
+		},
+	}
+}
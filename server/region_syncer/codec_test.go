@@ -0,0 +1,179 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+func TestNegotiateCodecPrefersRichestCommonCodec(t *testing.T) {
+	history := newHistoryBuffer(10, nil)
+	history.Record(nil)
+
+	cases := []struct {
+		name      string
+		supported []RegionSyncCodec
+		want      RegionSyncCodec
+	}{
+		{"none supported", nil, RegionSyncCodecFull},
+		{"snappy only", []RegionSyncCodec{RegionSyncCodecSnappy}, RegionSyncCodecSnappy},
+		{"delta and snappy", []RegionSyncCodec{RegionSyncCodecSnappy, RegionSyncCodecDelta}, RegionSyncCodecDelta},
+	}
+	for _, c := range cases {
+		if got := negotiateCodec(c.supported, 0, history); got != c.want {
+			t.Errorf("%s: negotiateCodec() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestNegotiateCodecFallsBackWhenHistoryDoesNotCoverStartIndex(t *testing.T) {
+	history := newHistoryBuffer(1, nil)
+	history.Record(nil)
+	history.Record(nil)
+
+	got := negotiateCodec([]RegionSyncCodec{RegionSyncCodecDelta, RegionSyncCodecSnappy}, 0, history)
+	if got != RegionSyncCodecSnappy {
+		t.Fatalf("negotiateCodec() = %v, want RegionSyncCodecSnappy when startIndex is out of the retained window", got)
+	}
+}
+
+func TestDiffRegionReturnsFullRegionOnFirstSight(t *testing.T) {
+	f := newFollowerStream("f1", nil, 0, 0, RegionSyncCodecDelta)
+	region := &metapb.Region{Id: 1, StartKey: []byte("a")}
+
+	got := f.diffRegion(region)
+	if got != region {
+		t.Fatalf("diffRegion() = %v, want the original region on first sight", got)
+	}
+}
+
+func TestDiffRegionReturnsOnlyChangedFields(t *testing.T) {
+	f := newFollowerStream("f1", nil, 0, 0, RegionSyncCodecDelta)
+	first := &metapb.Region{
+		Id:          1,
+		StartKey:    []byte("a"),
+		EndKey:      []byte("b"),
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1},
+		Peers:       []*metapb.Peer{{Id: 1, StoreId: 1}},
+	}
+	f.diffRegion(first)
+
+	second := &metapb.Region{
+		Id:          1,
+		StartKey:    []byte("a"),
+		EndKey:      []byte("c"),
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1},
+		Peers:       []*metapb.Peer{{Id: 1, StoreId: 1}},
+	}
+	delta := f.diffRegion(second)
+	if delta.GetStartKey() != nil {
+		t.Errorf("StartKey didn't change, want delta.StartKey = nil, got %q", delta.GetStartKey())
+	}
+	if string(delta.GetEndKey()) != "c" {
+		t.Errorf("EndKey changed, want delta.EndKey = %q, got %q", "c", delta.GetEndKey())
+	}
+	if delta.GetRegionEpoch() != nil {
+		t.Errorf("RegionEpoch didn't change, want delta.RegionEpoch = nil, got %v", delta.GetRegionEpoch())
+	}
+	if delta.GetPeers() != nil {
+		t.Errorf("Peers didn't change, want delta.Peers = nil, got %v", delta.GetPeers())
+	}
+}
+
+func TestPeersEqual(t *testing.T) {
+	a := []*metapb.Peer{{Id: 1, StoreId: 1}, {Id: 2, StoreId: 2}}
+	b := []*metapb.Peer{{Id: 1, StoreId: 1}, {Id: 2, StoreId: 2}}
+	if !peersEqual(a, b) {
+		t.Error("peersEqual() = false, want true for identical peer lists")
+	}
+
+	c := []*metapb.Peer{{Id: 1, StoreId: 1}}
+	if peersEqual(a, c) {
+		t.Error("peersEqual() = true, want false for lists of different length")
+	}
+
+	d := []*metapb.Peer{{Id: 1, StoreId: 1}, {Id: 2, StoreId: 9}}
+	if peersEqual(a, d) {
+		t.Error("peersEqual() = true, want false when a peer's fields differ")
+	}
+}
+
+func TestResponseForFallsBackToFullOnEmptyBatch(t *testing.T) {
+	b := &regionBatch{clusterID: 1, startIndex: 5}
+	resp := b.responseFor(RegionSyncCodecSnappy)
+	if resp.GetStartIndex() != 5 {
+		t.Fatalf("responseFor() returned StartIndex %d, want 5", resp.GetStartIndex())
+	}
+	if resp != b.fullResp {
+		t.Fatal("responseFor() didn't return the Full response for an empty batch")
+	}
+}
+
+func TestEncodeCompressedRoundTripsThroughSnappy(t *testing.T) {
+	b := &regionBatch{clusterID: 1, startIndex: 7}
+	regions := []*metapb.Region{{Id: 1, StartKey: []byte("a")}, {Id: 2, StartKey: []byte("b")}}
+
+	resp, err := b.encodeCompressed(RegionSyncCodecSnappy, regions)
+	if err != nil {
+		t.Fatalf("encodeCompressed() returned error: %v", err)
+	}
+
+	payload, err := snappy.Decode(nil, resp.GetCompressedRegions())
+	if err != nil {
+		t.Fatalf("snappy.Decode() returned error: %v", err)
+	}
+	want, err := marshalRegions(regions)
+	if err != nil {
+		t.Fatalf("marshalRegions() returned error: %v", err)
+	}
+	if string(payload) != string(want) {
+		t.Fatal("decoded payload doesn't match the marshaled regions it was encoded from")
+	}
+}
+
+func TestMarshalRegionsRoundTrips(t *testing.T) {
+	regions := []*metapb.Region{
+		{Id: 1, StartKey: []byte("a"), EndKey: []byte("b")},
+		{Id: 2, StartKey: []byte("b"), EndKey: []byte("c")},
+	}
+
+	data, err := marshalRegions(regions)
+	if err != nil {
+		t.Fatalf("marshalRegions() returned error: %v", err)
+	}
+
+	pos := 0
+	for i, want := range regions {
+		length, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			t.Fatalf("region %d: failed to parse varint length prefix", i)
+		}
+		pos += n
+		got := &metapb.Region{}
+		if err := got.Unmarshal(data[pos : pos+int(length)]); err != nil {
+			t.Fatalf("region %d: Unmarshal() returned error: %v", i, err)
+		}
+		pos += int(length)
+		if got.GetId() != want.GetId() {
+			t.Errorf("region %d: Id = %d, want %d", i, got.GetId(), want.GetId())
+		}
+	}
+	if pos != len(data) {
+		t.Fatalf("parsed %d bytes, want all %d consumed", pos, len(data))
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	stderrors "errors"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// isContextCanceled reports whether err is ultimately caused by a context
+// cancellation or deadline, the expected outcome of a follower shutting
+// down, a PD leader change, or a client deadline expiring, as opposed to a
+// genuine transport or protocol failure. It unwraps errors.WithStack via
+// errors.Cause before checking, since most errors in this package are
+// wrapped with it, and also recognizes the gRPC status codes a cancelled
+// context surfaces as once it has crossed the wire.
+func isContextCanceled(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if stderrors.Is(cause, context.Canceled) || stderrors.Is(cause, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(cause) {
+	case codes.Canceled, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"sync"
+
+	"github.com/pingcap/pd/server/core"
+)
+
+// historyBuffer is a ring buffer that keeps the most recent region change
+// records in memory so that a follower which only briefly fell behind can
+// catch up without requiring the leader to replay its full region set.
+type historyBuffer struct {
+	sync.RWMutex
+	nextIndex uint64
+	records   []*core.RegionInfo
+	size      int
+	kv        *core.KV
+}
+
+func newHistoryBuffer(size int, kv *core.KV) *historyBuffer {
+	return &historyBuffer{
+		size: size,
+		kv:   kv,
+	}
+}
+
+// Record appends a region change and advances the next index.
+func (h *historyBuffer) Record(r *core.RegionInfo) {
+	h.Lock()
+	defer h.Unlock()
+	h.records = append(h.records, r)
+	if len(h.records) > h.size {
+		h.records = h.records[len(h.records)-h.size:]
+	}
+	h.nextIndex++
+}
+
+// firstIndex returns the index of the oldest record still retained.
+// The caller must hold at least the read lock.
+func (h *historyBuffer) firstIndex() uint64 {
+	return h.nextIndex - uint64(len(h.records))
+}
+
+// RecordsFrom returns the records starting from index, or nil if index is
+// no longer covered by the buffer (either it is older than the oldest
+// retained record, or newer than what has been recorded so far).
+func (h *historyBuffer) RecordsFrom(index uint64) []*core.RegionInfo {
+	h.RLock()
+	defer h.RUnlock()
+	if index < h.firstIndex() || index > h.nextIndex {
+		return nil
+	}
+	pos := index - h.firstIndex()
+	return h.records[pos:]
+}
+
+// covers reports whether index is still a valid resume point: not older
+// than the oldest retained record (the ring buffer may have wrapped past it
+// since index was observed) and not newer than the next index to be
+// assigned. RecordsFrom returning no records is ambiguous between "nothing new
+// happened" and "index fell out of the window"; callers that need to tell
+// those apart should check covers first.
+func (h *historyBuffer) covers(index uint64) bool {
+	h.RLock()
+	defer h.RUnlock()
+	return index >= h.firstIndex() && index <= h.nextIndex
+}
+
+// GetNextIndex returns the index that will be assigned to the next record.
+func (h *historyBuffer) GetNextIndex() uint64 {
+	h.RLock()
+	defer h.RUnlock()
+	return h.nextIndex
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	snapshotDumpingGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "pd",
+			Subsystem: "syncer",
+			Name:      "snapshot_dumping",
+			Help:      "Gauge of full region snapshot dumps currently being streamed to followers.",
+		})
+
+	streamQueueGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "pd",
+			Subsystem: "syncer",
+			Name:      "stream_queue_size",
+			Help:      "Gauge of pending responses queued for each bound follower stream.",
+		}, []string{"follower"})
+
+	streamEvictedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "pd",
+			Subsystem: "syncer",
+			Name:      "stream_evicted_total",
+			Help:      "Counter of follower streams evicted for falling too far behind.",
+		})
+
+	streamCancelledCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "pd",
+			Subsystem: "syncer",
+			Name:      "stream_cancelled_total",
+			Help:      "Counter of sync streams that ended due to context cancellation or deadline expiry, rather than a genuine failure.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(snapshotDumpingGauge)
+	prometheus.MustRegister(streamQueueGauge)
+	prometheus.MustRegister(streamEvictedCounter)
+	prometheus.MustRegister(streamCancelledCounter)
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultQuiescePollInterval is how often Pause polls follower progress
+// while waiting for the cluster to drain up to the requested index.
+const defaultQuiescePollInterval = 20 * time.Millisecond
+
+// Lease identifies one outstanding Pause. It must be presented to Resume to
+// release the pause it was handed out for.
+type Lease struct {
+	id uint64
+}
+
+// quiesce tracks the pause-for-backup state shared by Pause and Resume.
+type quiesce struct {
+	mu      sync.Mutex
+	active  bool
+	lease   Lease
+	nextID  uint64
+	timer   *time.Timer
+	changed chan struct{}
+}
+
+func newQuiesce() *quiesce {
+	return &quiesce{changed: make(chan struct{})}
+}
+
+// isPausedAndWait reports whether RunServer should hold off recording new
+// region changes, and the channel that closes the next time that changes.
+// Both must come from one lock acquisition, or a racing Resume could hand
+// back a wait channel for the next pause and cause a missed wakeup.
+func (q *quiesce) isPausedAndWait() (bool, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active, q.changed
+}
+
+// notifyLocked wakes everyone blocked on wait. The caller must hold q.mu.
+func (q *quiesce) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Pause stops the syncer from recording new region changes and waits until
+// every bound follower has drained up to startIndex - or the leader's
+// current index, if startIndex is 0 - before returning the confirmed index.
+// ttl auto-resumes the pause if Resume is never called, so a crashed
+// coordinator can't wedge region propagation forever. If ctx is cancelled
+// first, Pause returns the best index observed so far along with
+// ctx.Err(), leaving the pause in place.
+func (s *RegionSyncer) Pause(ctx context.Context, startIndex uint64, ttl time.Duration) (Lease, uint64, error) {
+	s.quiesce.mu.Lock()
+	if s.quiesce.active {
+		s.quiesce.mu.Unlock()
+		return Lease{}, 0, errors.New("region syncer is already paused by another lease")
+	}
+	s.quiesce.nextID++
+	lease := Lease{id: s.quiesce.nextID}
+	s.quiesce.active = true
+	s.quiesce.lease = lease
+	s.quiesce.timer = time.AfterFunc(ttl, func() {
+		log.Warnf("region syncer pause lease %d expired after %s, auto-resuming", lease.id, ttl)
+		s.Resume(lease)
+	})
+	s.quiesce.notifyLocked()
+	s.quiesce.mu.Unlock()
+
+	target := startIndex
+	if target == 0 {
+		target = s.history.GetNextIndex()
+	}
+
+	ticker := time.NewTicker(defaultQuiescePollInterval)
+	defer ticker.Stop()
+	for {
+		if confirmed, ready := s.minFollowerIndex(target); ready {
+			// The ttl timer could have auto-resumed already, in which case
+			// followers catching up to target on their own looks identical
+			// to a real pause - so the lease must still be active to count.
+			s.quiesce.mu.Lock()
+			stillPaused := s.quiesce.active && s.quiesce.lease == lease
+			s.quiesce.mu.Unlock()
+			if !stillPaused {
+				return lease, confirmed, errors.Errorf("region syncer pause lease %d expired before all followers drained", lease.id)
+			}
+			log.Infof("region syncer paused, all followers drained to index %d", confirmed)
+			return lease, confirmed, nil
+		}
+		select {
+		case <-ctx.Done():
+			confirmed, _ := s.minFollowerIndex(target)
+			return lease, confirmed, errors.WithStack(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Resume releases a pause acquired through Pause. It is a no-op if lease no
+// longer matches the active pause, for example because it already expired
+// or was already resumed.
+func (s *RegionSyncer) Resume(lease Lease) {
+	s.quiesce.mu.Lock()
+	defer s.quiesce.mu.Unlock()
+	if !s.quiesce.active || s.quiesce.lease != lease {
+		return
+	}
+	s.quiesce.active = false
+	if s.quiesce.timer != nil {
+		s.quiesce.timer.Stop()
+	}
+	s.quiesce.notifyLocked()
+	log.Infof("region syncer resumed, releasing pause lease %d", lease.id)
+}
+
+// minFollowerIndex returns the lowest index every bound follower has
+// drained up to, capped at target, and whether every follower has reached
+// target.
+func (s *RegionSyncer) minFollowerIndex(target uint64) (uint64, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	min := target
+	ready := true
+	for _, follower := range s.streams {
+		if drained := follower.drainedIndex(); drained < target {
+			ready = false
+			if drained < min {
+				min = drained
+			}
+		}
+	}
+	return min, ready
+}
+
+// FollowerLag reports, for every bound follower, how many history records
+// behind the leader it is.
+func (s *RegionSyncer) FollowerLag() map[string]uint64 {
+	s.RLock()
+	lag := make(map[string]uint64, len(s.streams))
+	for name, follower := range s.streams {
+		lag[name] = follower.drainedIndex()
+	}
+	s.RUnlock()
+
+	// next must be read after every drained index above, not before: a
+	// follower can't be drained past what history has recorded, so reading
+	// next last keeps it >= every drained value and avoids the uint64
+	// underflow a batch recorded in between could otherwise cause.
+	next := s.history.GetNextIndex()
+	for name, drained := range lag {
+		if drained > next {
+			drained = next
+		}
+		lag[name] = next - drained
+	}
+	return lag
+}
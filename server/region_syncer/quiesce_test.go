@@ -0,0 +1,141 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestRegionSyncer() *RegionSyncer {
+	return &RegionSyncer{
+		streams: make(map[string]*followerStream),
+		history: newHistoryBuffer(10, nil),
+		quiesce: newQuiesce(),
+	}
+}
+
+// TestPauseSucceedsWhenFollowersDrainInTime is the non-racy baseline: a
+// follower that catches up well within ttl should make Pause return a nil
+// error with the confirmed index.
+func TestPauseSucceedsWhenFollowersDrainInTime(t *testing.T) {
+	s := newTestRegionSyncer()
+	follower := newFollowerStream("f1", nil, 0, 0, RegionSyncCodecFull)
+	s.streams["f1"] = follower
+
+	go func() {
+		time.Sleep(defaultQuiescePollInterval * 2)
+		atomic.StoreUint64(&follower.drained, 5)
+	}()
+
+	_, confirmed, err := s.Pause(context.Background(), 5, time.Second)
+	if err != nil {
+		t.Fatalf("expected Pause to succeed, got error: %v", err)
+	}
+	if confirmed != 5 {
+		t.Fatalf("expected confirmed index 5, got %d", confirmed)
+	}
+}
+
+// TestPauseReportsLeaseExpiryRace exercises the race 17b6f57 fixed: if the
+// TTL timer auto-resumes the lease before every follower is observed caught
+// up, Pause must not report success just because the followers happened to
+// reach target anyway - the lease they were supposedly frozen under was
+// already gone.
+func TestPauseReportsLeaseExpiryRace(t *testing.T) {
+	s := newTestRegionSyncer()
+	follower := newFollowerStream("f1", nil, 0, 0, RegionSyncCodecFull)
+	s.streams["f1"] = follower
+
+	const ttl = 2 * defaultQuiescePollInterval
+	go func() {
+		// Let the TTL timer fire and auto-Resume before the follower ever
+		// reaches target, so the only way Pause's poll loop can see
+		// ready=true is after the lease has already expired.
+		time.Sleep(ttl * 3)
+		atomic.StoreUint64(&follower.drained, 5)
+	}()
+
+	_, _, err := s.Pause(context.Background(), 5, ttl)
+	if err == nil {
+		t.Fatal("expected Pause to report an error when the lease expired before followers drained, got nil")
+	}
+}
+
+// TestResumeIgnoresStaleLease verifies Resume is a no-op against a lease
+// that no longer matches the active pause, so a late call from a
+// coordinator racing its own TTL expiry can't clobber a newer pause that
+// has since started.
+func TestResumeIgnoresStaleLease(t *testing.T) {
+	s := newTestRegionSyncer()
+
+	stale, _, err := s.Pause(context.Background(), 0, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error from first Pause: %v", err)
+	}
+	// The TTL above already auto-resumed this lease. Start a second, unrelated
+	// pause before the stale Resume below runs.
+	time.Sleep(30 * time.Millisecond)
+	active, _, err := s.Pause(context.Background(), 0, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error from second Pause: %v", err)
+	}
+
+	s.Resume(stale)
+
+	s.quiesce.mu.Lock()
+	stillActive := s.quiesce.active && s.quiesce.lease == active
+	s.quiesce.mu.Unlock()
+	if !stillActive {
+		t.Fatal("Resume with a stale lease released the newer, unrelated pause")
+	}
+}
+
+// TestFollowerLagReportsPerFollowerDistance is the non-racy baseline for
+// FollowerLag: each follower's lag is the leader's next index minus its own
+// drained index.
+func TestFollowerLagReportsPerFollowerDistance(t *testing.T) {
+	s := newTestRegionSyncer()
+	for i := 0; i < 3; i++ {
+		s.history.Record(nil)
+	}
+	s.streams["f1"] = newFollowerStream("f1", nil, 0, 1, RegionSyncCodecFull)
+	s.streams["f2"] = newFollowerStream("f2", nil, 0, 3, RegionSyncCodecFull)
+
+	lag := s.FollowerLag()
+	if lag["f1"] != 2 {
+		t.Fatalf("expected f1 lag 2, got %d", lag["f1"])
+	}
+	if lag["f2"] != 0 {
+		t.Fatalf("expected f2 lag 0, got %d", lag["f2"])
+	}
+}
+
+// TestFollowerLagClampsDrainedAheadOfNext guards the underflow FollowerLag
+// used to be able to report: a follower observed drained past history's
+// current next index must clamp to zero lag instead of underflowing the
+// uint64 subtraction into a number near 2^64.
+func TestFollowerLagClampsDrainedAheadOfNext(t *testing.T) {
+	s := newTestRegionSyncer()
+	follower := newFollowerStream("f1", nil, 0, 0, RegionSyncCodecFull)
+	atomic.StoreUint64(&follower.drained, 100)
+	s.streams["f1"] = follower
+
+	lag := s.FollowerLag()
+	if lag["f1"] != 0 {
+		t.Fatalf("expected lag to clamp to 0, got %d", lag["f1"])
+	}
+}
@@ -16,6 +16,7 @@ package syncer
 import (
 	"context"
 	"io"
+	"math"
 	"sync"
 	"time"
 
@@ -33,8 +34,19 @@ const (
 	maxSyncRegionBatchSize   = 100
 	syncerKeepAliveInterval  = 10 * time.Second
 	defaultHistoryBufferSize = 10000
+	// maxFullSyncAttempts bounds how many times syncFullRegion will redump
+	// the full region set to a follower when the history buffer wraps
+	// while the dump is in flight, before giving up with a hard failure.
+	maxFullSyncAttempts = 3
 )
 
+// fullSyncStartIndex is sent as the StartIndex of every SyncRegionResponse
+// that is part of a full snapshot dump (see syncFullRegion). It can never be
+// produced by the history buffer, so the client can tell a snapshot chunk
+// apart from an incremental one and wipe its local region state before
+// applying the first chunk.
+const fullSyncStartIndex = math.MaxUint64
+
 // ClientStream is the client side of the region syncer.
 type ClientStream interface {
 	Recv() (*pdpb.SyncRegionResponse, error)
@@ -59,13 +71,15 @@ type Server interface {
 // RegionSyncer is used to sync the region information without raft.
 type RegionSyncer struct {
 	sync.RWMutex
-	streams map[string]ServerStream
-	ctx     context.Context
-	cancel  context.CancelFunc
-	server  Server
-	closed  chan struct{}
-	wg      sync.WaitGroup
-	history *historyBuffer
+	streams             map[string]*followerStream
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	server              Server
+	closed              chan struct{}
+	wg                  sync.WaitGroup
+	history             *historyBuffer
+	slowFollowerTimeout time.Duration
+	quiesce             *quiesce
 }
 
 // NewRegionSyncer returns a region syncer.
@@ -75,88 +89,147 @@ type RegionSyncer struct {
 // no longer etcd but go-leveldb.
 func NewRegionSyncer(s Server) *RegionSyncer {
 	return &RegionSyncer{
-		streams: make(map[string]ServerStream),
-		server:  s,
-		closed:  make(chan struct{}),
-		history: newHistoryBuffer(defaultHistoryBufferSize, s.GetStorage().GetRegionKV()),
+		streams:             make(map[string]*followerStream),
+		server:              s,
+		closed:              make(chan struct{}),
+		history:             newHistoryBuffer(defaultHistoryBufferSize, s.GetStorage().GetRegionKV()),
+		slowFollowerTimeout: defaultSlowFollowerTimeout,
+		quiesce:             newQuiesce(),
 	}
 }
 
+// SetSlowFollowerTimeout overrides how long a follower's send queue may stay
+// continuously full before the follower is evicted. It must be called before
+// RunServer starts accepting followers.
+func (s *RegionSyncer) SetSlowFollowerTimeout(timeout time.Duration) {
+	s.slowFollowerTimeout = timeout
+}
+
 // RunServer runs the server of the region syncer.
 // regionNitifier is used to get the changed regions.
 func (s *RegionSyncer) RunServer(regionNotifier <-chan *core.RegionInfo, quit chan struct{}) {
-	var requests []*metapb.Region
 	ticker := time.NewTicker(syncerKeepAliveInterval)
 	for {
+		// While paused, keep draining regionNotifier but skip recording and
+		// broadcasting, so followers stay frozen at the pause index without
+		// backing up heartbeat handling upstream. paused and waitCh must
+		// come from one lock acquisition, or a racing Resume could hand back
+		// a waitCh for the next pause and miss this wakeup.
+		paused, waitCh := s.quiesce.isPausedAndWait()
 		select {
 		case <-quit:
 			log.Info("exit region syncer")
 			return
+		case <-waitCh:
 		case first := <-regionNotifier:
-			requests = append(requests, first.GetMeta())
+			pending := len(regionNotifier)
+			if paused {
+				// Drain whatever else is already queued up too, without
+				// recording or broadcasting any of it.
+				for i := 0; i < pending && i < maxSyncRegionBatchSize; i++ {
+					<-regionNotifier
+				}
+				continue
+			}
+			// Each batch is handed off to per-follower goroutines that may
+			// encode and send it at their own pace (see broadcast), so a
+			// fresh slice is allocated for every batch rather than reusing
+			// one across iterations.
+			requests := []*metapb.Region{first.GetMeta()}
 			startIndex := s.history.GetNextIndex()
 			s.history.Record(first)
-			pending := len(regionNotifier)
 			for i := 0; i < pending && i < maxSyncRegionBatchSize; i++ {
 				region := <-regionNotifier
 				requests = append(requests, region.GetMeta())
 				s.history.Record(region)
 			}
-			regions := &pdpb.SyncRegionResponse{
-				Header:     &pdpb.ResponseHeader{ClusterId: s.server.ClusterID()},
-				Regions:    requests,
-				StartIndex: startIndex,
-			}
-			s.broadcast(regions)
+			s.broadcast(&regionBatch{
+				clusterID:  s.server.ClusterID(),
+				startIndex: startIndex,
+				regions:    requests,
+			})
 		case <-ticker.C:
-			alive := &pdpb.SyncRegionResponse{
-				Header:     &pdpb.ResponseHeader{ClusterId: s.server.ClusterID()},
-				StartIndex: s.history.GetNextIndex(),
-			}
-			s.broadcast(alive)
+			s.broadcast(&regionBatch{
+				clusterID:  s.server.ClusterID(),
+				startIndex: s.history.GetNextIndex(),
+			})
 		}
-		requests = requests[:0]
 	}
 }
 
 // Sync firstly tries to sync the history records to client.
 // then to sync the latest records.
 func (s *RegionSyncer) Sync(stream pdpb.PD_SyncRegionsServer) error {
-	for {
-		request, err := stream.Recv()
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			return errors.WithStack(err)
+	var follower *followerStream
+	defer func() {
+		if follower != nil {
+			s.unbindStream(follower.name, follower)
 		}
-		clusterID := request.GetHeader().GetClusterId()
-		if clusterID != s.server.ClusterID() {
-			return status.Errorf(codes.FailedPrecondition, "mismatch cluster id, need %d but got %d", s.server.ClusterID(), clusterID)
+	}()
+
+	type recvResult struct {
+		request *pdpb.SyncRegionRequest
+		err     error
+	}
+	recvCh := make(chan recvResult, 1)
+	recv := func() {
+		request, err := stream.Recv()
+		recvCh <- recvResult{request, err}
+	}
+	go recv()
+
+	for {
+		var evicted <-chan struct{}
+		if follower != nil {
+			evicted = follower.evicted
 		}
-		log.Infof("establish sync region stream with %s [%s]", request.GetMember().GetName(), request.GetMember().GetClientUrls()[0])
+		select {
+		case res := <-recvCh:
+			if res.err == io.EOF {
+				return nil
+			}
+			if res.err != nil {
+				if isContextCanceled(res.err) {
+					log.Infof("region sync stream closed: %v", res.err)
+					streamCancelledCounter.Inc()
+					return nil
+				}
+				return errors.WithStack(res.err)
+			}
+			request := res.request
+			clusterID := request.GetHeader().GetClusterId()
+			if clusterID != s.server.ClusterID() {
+				return status.Errorf(codes.FailedPrecondition, "mismatch cluster id, need %d but got %d", s.server.ClusterID(), clusterID)
+			}
+			log.Infof("establish sync region stream with %s [%s]", request.GetMember().GetName(), request.GetMember().GetClientUrls()[0])
 
-		err = s.syncHistoryRegion(request, stream)
-		if err != nil {
-			return err
+			flushed, err := s.syncHistoryRegion(request, stream)
+			if err != nil {
+				return err
+			}
+			codec := negotiateCodec(supportedCodecsFrom(request), request.GetStartIndex(), s.history)
+			follower = s.bindStream(request.GetMember().GetName(), stream, flushed, codec)
+			go recv()
+		case <-evicted:
+			return errors.Errorf("region syncer evicted slow follower %s", follower.name)
 		}
-		s.bindStream(request.GetMember().GetName(), stream)
 	}
 }
 
-func (s *RegionSyncer) syncHistoryRegion(request *pdpb.SyncRegionRequest, stream pdpb.PD_SyncRegionsServer) error {
+// syncHistoryRegion replies with whatever the history buffer or a full
+// snapshot can offer, and returns the index actually flushed to the
+// follower, which bindStream uses as its drained baseline (see bindStream).
+func (s *RegionSyncer) syncHistoryRegion(request *pdpb.SyncRegionRequest, stream pdpb.PD_SyncRegionsServer) (uint64, error) {
 	startIndex := request.GetStartIndex()
 	name := request.GetMember().GetName()
 	records := s.history.RecordsFrom(startIndex)
 	if len(records) == 0 {
 		if s.history.GetNextIndex() == startIndex {
 			log.Infof("%s already in sync with %s, the last index is %d", name, s.server.Name(), startIndex)
-			return nil
+			return startIndex, nil
 		}
 		log.Warnf("no history regions from index %d, the leader maybe restarted", startIndex)
-		// TODO: Full synchronization
-		// if startIndex == 0 {}
-		return nil
+		return s.syncFullRegion(name, stream)
 	}
 	log.Infof("sync the history regions with %s from index: %d, own last index: %d, got records length: %d",
 		name, startIndex, s.history.GetNextIndex(), len(records))
@@ -164,37 +237,214 @@ func (s *RegionSyncer) syncHistoryRegion(request *pdpb.SyncRegionRequest, stream
 	for i, r := range records {
 		regions[i] = r.GetMeta()
 	}
-	resp := &pdpb.SyncRegionResponse{
-		Header:     &pdpb.ResponseHeader{ClusterId: s.server.ClusterID()},
-		Regions:    regions,
-		StartIndex: startIndex,
+	resp := buildSyncRegionResponse(s.server.ClusterID(), startIndex, regions, RegionSyncCodecFull, nil)
+	if err := stream.Send(resp); err != nil {
+		if isContextCanceled(err) {
+			log.Infof("region sync stream with %s closed while sending history: %v", name, err)
+			streamCancelledCounter.Inc()
+			return startIndex, nil
+		}
+		return 0, errors.WithStack(err)
+	}
+	// len(records) is exactly what was sent above, unlike a fresh
+	// GetNextIndex() call which could have moved on by now.
+	return startIndex + uint64(len(records)), nil
+}
+
+// syncFullRegion streams every region the leader knows about to a follower
+// whose startIndex is older than anything the history buffer still
+// retains, and returns the index it is confirmed to have received up to
+// (see syncHistoryRegion). If the history buffer wraps while the dump is
+// in flight, the post-dump catch-up replay below it tried to send would be
+// gone, so the whole dump is retried up to maxFullSyncAttempts times.
+func (s *RegionSyncer) syncFullRegion(name string, stream pdpb.PD_SyncRegionsServer) (uint64, error) {
+	for attempt := 1; attempt <= maxFullSyncAttempts; attempt++ {
+		// The buffer keeps recording regardless of whether this stream is
+		// bound, so nothing recorded during the dump is lost - it just
+		// needs replaying afterwards, unless the buffer wrapped past this.
+		resumeIndex := s.history.GetNextIndex()
+
+		closed, err := s.dumpFullRegion(name, stream)
+		if err != nil {
+			return 0, err
+		}
+		if closed {
+			return resumeIndex, nil
+		}
+
+		if !s.history.covers(resumeIndex) {
+			log.Warnf("history buffer wrapped while dumping full region snapshot to %s (attempt %d/%d), retrying",
+				name, attempt, maxFullSyncAttempts)
+			continue
+		}
+
+		records := s.history.RecordsFrom(resumeIndex)
+		if len(records) == 0 {
+			log.Infof("finished full region sync with %s, resuming from index %d", name, s.history.GetNextIndex())
+			return resumeIndex, nil
+		}
+
+		flushed, err := s.replayPostSnapshot(name, stream, resumeIndex, records)
+		if err != nil {
+			return 0, err
+		}
+		log.Infof("finished full region sync with %s, resuming from index %d", name, flushed)
+		return flushed, nil
+	}
+	return 0, errors.Errorf("region syncer could not dump a full snapshot to %s without the history buffer wrapping, after %d attempts",
+		name, maxFullSyncAttempts)
+}
+
+// replayPostSnapshot sends records - everything recorded between
+// resumeIndex and now, while the snapshot dump was in flight - to stream in
+// the same bounded batches dumpFullRegion uses for the dump itself, and
+// returns the index the follower is confirmed to have received up to.
+func (s *RegionSyncer) replayPostSnapshot(name string, stream pdpb.PD_SyncRegionsServer, resumeIndex uint64, records []*core.RegionInfo) (uint64, error) {
+	flushed := resumeIndex
+	var regions []*metapb.Region
+	var batchSize int
+	flush := func() error {
+		if len(regions) == 0 {
+			return nil
+		}
+		resp := buildSyncRegionResponse(s.server.ClusterID(), flushed, regions, RegionSyncCodecFull, nil)
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		flushed += uint64(len(regions))
+		regions = nil
+		batchSize = 0
+		return nil
+	}
+
+	for _, r := range records {
+		region := r.GetMeta()
+		regions = append(regions, region)
+		batchSize += region.Size()
+		if len(regions) >= maxSyncRegionBatchSize || batchSize >= msgSize {
+			if err := flush(); err != nil {
+				if isContextCanceled(err) {
+					log.Infof("region sync stream with %s closed while replaying post-snapshot updates: %v", name, err)
+					streamCancelledCounter.Inc()
+					return flushed, nil
+				}
+				return 0, errors.WithStack(err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		if isContextCanceled(err) {
+			log.Infof("region sync stream with %s closed while replaying post-snapshot updates: %v", name, err)
+			streamCancelledCounter.Inc()
+			return flushed, nil
+		}
+		return 0, errors.WithStack(err)
 	}
-	return stream.Send(resp)
+	return flushed, nil
 }
 
-// bindStream binds the established server stream.
-func (s *RegionSyncer) bindStream(name string, stream ServerStream) {
+// dumpFullRegion streams every region currently known to the leader to
+// stream in bounded batches. It reports closed=true if the stream ended
+// because of context cancellation partway through, in which case the
+// caller should treat the sync as finished rather than as an error.
+func (s *RegionSyncer) dumpFullRegion(name string, stream pdpb.PD_SyncRegionsServer) (closed bool, err error) {
+	log.Infof("starting full region sync with %s", name)
+	snapshotDumpingGauge.Inc()
+	defer snapshotDumpingGauge.Dec()
+
+	var regions []*metapb.Region
+	var batchSize int
+	flush := func() error {
+		if len(regions) == 0 {
+			return nil
+		}
+		resp := buildSyncRegionResponse(s.server.ClusterID(), fullSyncStartIndex, regions, RegionSyncCodecFull, nil)
+		regions = nil
+		batchSize = 0
+		return stream.Send(resp)
+	}
+
+	loadErr := s.server.GetStorage().LoadRegions(func(region *metapb.Region) error {
+		regions = append(regions, region)
+		batchSize += region.Size()
+		if len(regions) >= maxSyncRegionBatchSize || batchSize >= msgSize {
+			return flush()
+		}
+		return nil
+	})
+	if loadErr == nil {
+		loadErr = flush()
+	}
+	if loadErr != nil {
+		if isContextCanceled(loadErr) {
+			log.Infof("region sync stream with %s closed during full sync: %v", name, loadErr)
+			streamCancelledCounter.Inc()
+			return true, nil
+		}
+		return false, errors.WithStack(loadErr)
+	}
+	return false, nil
+}
+
+// bindStream binds the established server stream, replacing any previous
+// stream bound under the same follower name, and returns the followerStream
+// so the caller can watch it for eviction. drained must be the index
+// syncHistoryRegion/syncFullRegion actually flushed to this follower, not a
+// fresh GetNextIndex() read - RunServer could Record and broadcast a batch
+// in the gap before this follower is inserted into s.streams below, which
+// it would then never receive despite drained claiming otherwise.
+func (s *RegionSyncer) bindStream(name string, stream ServerStream, drained uint64, codec RegionSyncCodec) *followerStream {
+	follower := newFollowerStream(name, stream, s.slowFollowerTimeout, drained, codec)
+	s.Lock()
+	if old, ok := s.streams[name]; ok {
+		old.evict()
+	}
+	s.streams[name] = follower
+	s.Unlock()
+	go follower.run()
+	return follower
+}
+
+// unbindStream removes the follower from the stream table, but only if it
+// is still the stream we installed (a later reconnect may already have
+// replaced it).
+func (s *RegionSyncer) unbindStream(name string, follower *followerStream) {
 	s.Lock()
 	defer s.Unlock()
-	s.streams[name] = stream
+	if s.streams[name] == follower {
+		delete(s.streams, name)
+	}
 }
 
-func (s *RegionSyncer) broadcast(regions *pdpb.SyncRegionResponse) {
-	var failed []string
+// broadcast enqueues batch onto every bound follower's send queue. The
+// enqueue is non-blocking, so a single slow or hung follower can no longer
+// stall delivery to the rest of the cluster; a follower whose queue stays
+// full for too long is evicted by followerStream.enqueue itself. Each
+// follower renders batch according to its own negotiated codec when it is
+// actually sent (see followerStream.run), not here.
+func (s *RegionSyncer) broadcast(batch *regionBatch) {
+	var evicted []*followerStream
 	s.RLock()
-	for name, sender := range s.streams {
-		err := sender.Send(regions)
-		if err != nil {
-			log.Error("region syncer send data meet error:", err)
-			failed = append(failed, name)
+	for _, follower := range s.streams {
+		if follower.enqueue(batch) {
+			continue
+		}
+		// A full queue alone leaves the follower bound; only a follower
+		// that enqueue has actually evicted is removed here.
+		select {
+		case <-follower.evicted:
+			evicted = append(evicted, follower)
+		default:
 		}
 	}
 	s.RUnlock()
-	if len(failed) > 0 {
+	if len(evicted) > 0 {
 		s.Lock()
-		for _, name := range failed {
-			delete(s.streams, name)
-			log.Infof("region syncer delete the stream of %s", name)
+		for _, follower := range evicted {
+			if s.streams[follower.name] == follower {
+				delete(s.streams, follower.name)
+				log.Infof("region syncer delete the stream of %s", follower.name)
+			}
 		}
 		s.Unlock()
 	}
@@ -0,0 +1,221 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// followerQueueSize is the number of pending batches a follower stream
+	// may buffer before it is considered for eviction.
+	followerQueueSize = 1024
+	// defaultSlowFollowerTimeout is how long a follower's queue may stay
+	// continuously full before it is evicted.
+	defaultSlowFollowerTimeout = 10 * time.Second
+)
+
+// followerStream owns the goroutine and bounded queue used to forward
+// region batches to one bound follower. broadcast only ever enqueues into
+// respCh, so a single slow or hung follower can no longer block
+// propagation to the rest of the cluster.
+type followerStream struct {
+	name   string
+	sender ServerStream
+	codec  RegionSyncCodec
+	respCh chan *regionBatch
+
+	evictTimeout time.Duration
+	evicted      chan struct{}
+	evictOnce    sync.Once
+
+	mu         sync.Mutex
+	overflowAt time.Time
+
+	// drained is the history index this follower has been confirmed to have
+	// received up to. It starts at the index the follower was caught up to
+	// when the stream was bound, and advances as batches are sent
+	// successfully. Pause polls it to know when every follower has observed
+	// a given index.
+	drained uint64
+
+	// lastShipped is this follower's own baseline for the delta codec: the
+	// last full version of each region sent to it, keyed by region ID. It
+	// is only ever read and written from run, so it needs no locking.
+	// Keeping it per-follower (rather than shared across all followers, as
+	// an earlier version of this code did) matters for correctness, not
+	// just isolation: a freshly bound follower starts with an empty map,
+	// so the first delta it is sent for any given region always falls back
+	// to the full region instead of being diffed against some other
+	// follower's (or a stale, long-gone follower's) last-shipped state.
+	lastShipped map[uint64]*metapb.Region
+}
+
+func newFollowerStream(name string, sender ServerStream, evictTimeout time.Duration, initialIndex uint64, codec RegionSyncCodec) *followerStream {
+	return &followerStream{
+		name:         name,
+		sender:       sender,
+		codec:        codec,
+		respCh:       make(chan *regionBatch, followerQueueSize),
+		evictTimeout: evictTimeout,
+		evicted:      make(chan struct{}),
+		drained:      initialIndex,
+		lastShipped:  make(map[uint64]*metapb.Region),
+	}
+}
+
+// run renders and forwards batches from respCh to the underlying stream,
+// using the codec this follower negotiated, until the follower is evicted
+// or a Send fails.
+func (f *followerStream) run() {
+	defer streamQueueGauge.DeleteLabelValues(f.name)
+	for {
+		select {
+		case batch := <-f.respCh:
+			streamQueueGauge.WithLabelValues(f.name).Set(float64(len(f.respCh)))
+			if err := f.sender.Send(f.render(batch)); err != nil {
+				if isContextCanceled(err) {
+					log.Infof("region sync stream with %s closed: %v", f.name, err)
+					streamCancelledCounter.Inc()
+				} else {
+					log.Errorf("region syncer send data to %s meet error: %v", f.name, err)
+				}
+				f.evict()
+				return
+			}
+			atomic.StoreUint64(&f.drained, batch.startIndex+uint64(len(batch.regions)))
+		case <-f.evicted:
+			return
+		}
+	}
+}
+
+// render produces this follower's wire representation of batch. Full and
+// Snappy encodings don't depend on follower state, so they're delegated to
+// batch.responseFor, which caches them for every follower sharing that
+// codec. Delta encoding depends on this follower's own lastShipped
+// baseline and so is always computed fresh here rather than cached on the
+// shared batch.
+func (f *followerStream) render(batch *regionBatch) *pdpb.SyncRegionResponse {
+	if f.codec != RegionSyncCodecDelta || len(batch.regions) == 0 {
+		return batch.responseFor(f.codec)
+	}
+	deltas := make([]*metapb.Region, len(batch.regions))
+	for i, region := range batch.regions {
+		deltas[i] = f.diffRegion(region)
+	}
+	resp, err := batch.encodeCompressed(RegionSyncCodecDelta, deltas)
+	if err != nil {
+		return batch.responseFor(RegionSyncCodecFull)
+	}
+	return resp
+}
+
+// diffRegion returns the fields of region that differ from the last
+// version shipped to this follower under the delta codec, and records
+// region as the new baseline. The first time a region ID is seen on this
+// stream, there is nothing to diff against, so the full region is
+// returned.
+func (f *followerStream) diffRegion(region *metapb.Region) *metapb.Region {
+	prev, ok := f.lastShipped[region.GetId()]
+	f.lastShipped[region.GetId()] = region
+	if !ok {
+		return region
+	}
+
+	delta := &metapb.Region{Id: region.GetId()}
+	if !bytes.Equal(prev.GetStartKey(), region.GetStartKey()) {
+		delta.StartKey = region.GetStartKey()
+	}
+	if !bytes.Equal(prev.GetEndKey(), region.GetEndKey()) {
+		delta.EndKey = region.GetEndKey()
+	}
+	if !proto.Equal(prev.GetRegionEpoch(), region.GetRegionEpoch()) {
+		delta.RegionEpoch = region.GetRegionEpoch()
+	}
+	if !peersEqual(prev.GetPeers(), region.GetPeers()) {
+		delta.Peers = region.GetPeers()
+	}
+	return delta
+}
+
+func peersEqual(a, b []*metapb.Peer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// drainedIndex returns the last history index this follower is confirmed to
+// have received.
+func (f *followerStream) drainedIndex() uint64 {
+	return atomic.LoadUint64(&f.drained)
+}
+
+// enqueue offers batch to the follower without blocking and reports whether
+// it was queued. A full queue drops batch and returns false; if the queue
+// has been continuously full for longer than evictTimeout, the follower is
+// evicted as well. An already evicted follower always returns false.
+func (f *followerStream) enqueue(batch *regionBatch) bool {
+	select {
+	case <-f.evicted:
+		return false
+	default:
+	}
+
+	select {
+	case f.respCh <- batch:
+		streamQueueGauge.WithLabelValues(f.name).Set(float64(len(f.respCh)))
+		f.mu.Lock()
+		f.overflowAt = time.Time{}
+		f.mu.Unlock()
+		return true
+	default:
+	}
+
+	f.mu.Lock()
+	if f.overflowAt.IsZero() {
+		f.overflowAt = time.Now()
+	}
+	overflowed := time.Since(f.overflowAt) > f.evictTimeout
+	f.mu.Unlock()
+
+	if overflowed {
+		log.Warnf("region syncer queue for %s has been full for more than %s, evicting", f.name, f.evictTimeout)
+		f.evict()
+	}
+	return false
+}
+
+// evict stops the follower's goroutine and marks it evicted so Sync can
+// tear down the underlying RPC and force the follower to reconnect.
+func (f *followerStream) evict() {
+	f.evictOnce.Do(func() {
+		streamEvictedCounter.Inc()
+		close(f.evicted)
+	})
+}
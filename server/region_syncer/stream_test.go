@@ -0,0 +1,111 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/pdpb"
+)
+
+type nopSender struct{}
+
+func (nopSender) Send(*pdpb.SyncRegionResponse) error { return nil }
+
+// fillQueue enqueues enough batches to leave f's queue completely full,
+// without anything draining it (run is never started in these tests).
+func fillQueue(t *testing.T, f *followerStream) {
+	t.Helper()
+	for i := 0; i < followerQueueSize; i++ {
+		if !f.enqueue(&regionBatch{}) {
+			t.Fatalf("enqueue %d: expected the queue to accept up to followerQueueSize batches", i)
+		}
+	}
+}
+
+// TestFollowerStreamBackpressureWithoutEviction verifies that a full queue
+// alone isn't enough to evict a follower: enqueue must keep reporting the
+// queue as full without tripping eviction until it has stayed full for
+// evictTimeout.
+func TestFollowerStreamBackpressureWithoutEviction(t *testing.T) {
+	f := newFollowerStream("slow", nopSender{}, time.Hour, 0, RegionSyncCodecFull)
+	fillQueue(t, f)
+
+	if f.enqueue(&regionBatch{}) {
+		t.Fatal("expected enqueue to report the queue as full")
+	}
+	select {
+	case <-f.evicted:
+		t.Fatal("follower was evicted even though evictTimeout hasn't elapsed")
+	default:
+	}
+}
+
+// TestFollowerStreamEvictsAfterTimeout verifies that once a follower's queue
+// has stayed continuously full for longer than evictTimeout, the next
+// enqueue attempt evicts it.
+func TestFollowerStreamEvictsAfterTimeout(t *testing.T) {
+	const evictTimeout = 20 * time.Millisecond
+	f := newFollowerStream("slow", nopSender{}, evictTimeout, 0, RegionSyncCodecFull)
+	fillQueue(t, f)
+
+	// First overflowing enqueue just starts the overflow clock.
+	if f.enqueue(&regionBatch{}) {
+		t.Fatal("expected enqueue to report the queue as full")
+	}
+
+	time.Sleep(evictTimeout * 3)
+
+	if f.enqueue(&regionBatch{}) {
+		t.Fatal("expected enqueue to still report the queue as full")
+	}
+	select {
+	case <-f.evicted:
+	default:
+		t.Fatal("expected follower to be evicted once its queue stayed full past evictTimeout")
+	}
+}
+
+// TestFollowerStreamEnqueueResetsOverflowClock verifies that the queue
+// draining even briefly resets the overflow clock, so a follower that is
+// merely slow - not hung - isn't evicted just because it was momentarily
+// behind.
+func TestFollowerStreamEnqueueResetsOverflowClock(t *testing.T) {
+	const evictTimeout = 20 * time.Millisecond
+	f := newFollowerStream("slow", nopSender{}, evictTimeout, 0, RegionSyncCodecFull)
+	fillQueue(t, f)
+
+	if f.enqueue(&regionBatch{}) {
+		t.Fatal("expected enqueue to report the queue as full")
+	}
+	time.Sleep(evictTimeout / 2)
+
+	// Drain one slot and refill it, simulating the consumer making a little
+	// progress before the timeout would otherwise trip.
+	<-f.respCh
+	if !f.enqueue(&regionBatch{}) {
+		t.Fatal("expected enqueue to succeed once a slot was freed")
+	}
+
+	time.Sleep(evictTimeout / 2)
+	if f.enqueue(&regionBatch{}) {
+		t.Fatal("expected enqueue to report the queue as full")
+	}
+	select {
+	case <-f.evicted:
+		t.Fatal("follower was evicted even though the queue drained within evictTimeout")
+	default:
+	}
+}
@@ -0,0 +1,50 @@
+// +build pdnext
+
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+// STATUS: blocked, not reachable in this tree. This is the real wire-level
+// implementation, gated behind a kvproto checkout that has RegionSyncCodec
+// and the SupportedCodecs/Codec/CompressedRegions fields (see wire_stub.go,
+// which is what the default build links instead).
+
+import (
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+)
+
+// supportedCodecsFrom reads the codecs a follower advertised.
+func supportedCodecsFrom(request *pdpb.SyncRegionRequest) []RegionSyncCodec {
+	wire := request.GetSupportedCodecs()
+	supported := make([]RegionSyncCodec, len(wire))
+	for i, c := range wire {
+		supported[i] = RegionSyncCodec(c)
+	}
+	return supported
+}
+
+// buildSyncRegionResponse stamps codec and the already-encoded compressed
+// payload onto the response. regions and compressed are mutually exclusive:
+// pass regions for an uncompressed response, compressed (with regions nil)
+// for a Snappy- or Delta-encoded one.
+func buildSyncRegionResponse(clusterID, startIndex uint64, regions []*metapb.Region, codec RegionSyncCodec, compressed []byte) *pdpb.SyncRegionResponse {
+	return &pdpb.SyncRegionResponse{
+		Header:            &pdpb.ResponseHeader{ClusterId: clusterID},
+		Regions:           regions,
+		StartIndex:        startIndex,
+		Codec:             pdpb.RegionSyncCodec(codec),
+		CompressedRegions: compressed,
+	}
+}
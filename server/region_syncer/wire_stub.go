@@ -0,0 +1,44 @@
+// +build !pdnext
+
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+// STATUS: this is the default build. The vendored kvproto here has no
+// RegionSyncCodec or SupportedCodecs/Codec/CompressedRegions fields (see
+// wire_pdnext.go), so every follower negotiates down to RegionSyncCodecFull
+// and chunk0-4's delta/compressed encoding never actually reaches the wire.
+
+import (
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+)
+
+// supportedCodecsFrom always reports that a follower only supports Full:
+// SyncRegionRequest.SupportedCodecs doesn't exist in the vendored kvproto,
+// so there is no way to learn otherwise.
+func supportedCodecsFrom(request *pdpb.SyncRegionRequest) []RegionSyncCodec {
+	return nil
+}
+
+// buildSyncRegionResponse ignores codec and compressed: SyncRegionResponse
+// has no Codec or CompressedRegions field to carry them in this build, so
+// every response it produces is necessarily the full, uncompressed form.
+func buildSyncRegionResponse(clusterID, startIndex uint64, regions []*metapb.Region, codec RegionSyncCodec, compressed []byte) *pdpb.SyncRegionResponse {
+	return &pdpb.SyncRegionResponse{
+		Header:     &pdpb.ResponseHeader{ClusterId: clusterID},
+		Regions:    regions,
+		StartIndex: startIndex,
+	}
+}